@@ -1,46 +1,188 @@
 package main
 
 import (
+	"compress/flate"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-const (
+// Package-level defaults for NamedWebSocketConfig, used whenever a nil
+// config is passed to NewNamedWebSocket. The command entrypoint may
+// override these via flags before any sockets are created.
+var (
 	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
 
 	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	DefaultReadTimeout = 60 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+	// Send pings to peer with this period. Must be less than DefaultReadTimeout.
+	DefaultPingFrequency = (DefaultReadTimeout * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 1024
+	DefaultMaxMessageSize int64 = 1024
+
+	// How long a non-proxy peer may stay idle before it's disconnected.
+	DefaultDisconnectAfter = 10 * time.Minute
+
+	// flate compression level used when a socket has compression enabled.
+	DefaultCompressionLevel = flate.DefaultCompression
+
+	// Messages smaller than this are sent uncompressed even when
+	// compression is enabled, since the framing overhead isn't worth it.
+	DefaultMinCompressSize = 256
+)
+
+const (
+	// Size of the buffered outbound channel for each connection.
+	sendBufferSize = 256
 )
 
+// NamedWebSocketConfig controls the timeouts and idle-disconnect policy for
+// a single NamedWebSocket, so operators can tune these per named socket
+// instead of relying on fixed package-wide constants.
+type NamedWebSocketConfig struct {
+	// Time allowed to write a message to a peer.
+	WriteTimeout time.Duration
+
+	// Time allowed to read the next pong message from a peer. Also used as
+	// the read deadline.
+	ReadTimeout time.Duration
+
+	// How often to ping peers to keep the connection alive.
+	PingFrequency time.Duration
+
+	// Maximum message size allowed from a peer.
+	MaxMessageSize int64
+
+	// How long a non-proxy peer may go without sending a message before
+	// it's disconnected as idle. Proxy connections are never idle-disconnected.
+	DisconnectAfter time.Duration
+
+	// Whether to compress messages written to this socket's peers. The
+	// shared upgrader offers permessage-deflate on every socket; this field
+	// controls only whether outbound writes use it. Large JSON payloads are the common case for a named
+	// websocket, so this defaults on for broadcast sockets; local sockets
+	// default off but can opt in.
+	EnableCompression bool
+
+	// flate compression level used when EnableCompression is set.
+	CompressionLevel int
+
+	// Messages smaller than this are written uncompressed even when
+	// EnableCompression is set.
+	MinCompressSize int
+}
+
+// defaultNamedWebSocketConfig builds a NamedWebSocketConfig from today's
+// package-level defaults. Compression defaults on for broadcast sockets,
+// since proxy-relayed traffic benefits most, and off for local ones.
+func defaultNamedWebSocketConfig(isBroadcast bool) *NamedWebSocketConfig {
+	return &NamedWebSocketConfig{
+		WriteTimeout: DefaultWriteTimeout,
+		ReadTimeout: DefaultReadTimeout,
+		PingFrequency: DefaultPingFrequency,
+		MaxMessageSize: DefaultMaxMessageSize,
+		DisconnectAfter: DefaultDisconnectAfter,
+		EnableCompression: isBroadcast,
+		CompressionLevel: DefaultCompressionLevel,
+		MinCompressSize: DefaultMinCompressSize,
+	}
+}
+
 type NamedWebSocket struct {
 	serviceName string
 
-	// The current websocket connection instances to this named websocket
-	connections []*Connection
+	// Timeouts and idle-disconnect policy for this named websocket
+	config *NamedWebSocketConfig
+
+	// The current set of websocket connection instances to this named websocket
+	connections map[*Connection]struct{}
+
+	// Non-proxy connections indexed by their peer ID, for directed "to" publishes
+	peers map[string]*Connection
+
+	// Topics each non-proxy connection has subscribed to
+	subscriptions map[*Connection]map[string]struct{}
+
+	// Register requests from new websocket connections
+	register chan *Connection
+
+	// Unregister requests from websocket connections that have gone away
+	unregister chan *Connection
 
 	// Buffered channel of outbound service messages.
 	broadcastBuffer chan *WSMessage
 
-	// Buffered channel of outbound connect/disconnect messages
-	controlBuffer chan *WSMessage
+	// Connections that have opted into the structured JSON envelope
+	// protocol, by sending a recognized subscribe/unsubscribe/publish
+	// envelope. These receive lifecycle events as envelopes instead of
+	// the legacy connect/disconnect sentinels.
+	protocolOptIn map[*Connection]struct{}
+
+	// External channels registered via Subscribe/Unsubscribe to observe
+	// peer lifecycle events without parsing websocket frames
+	controlSubscribers map[chan ControlEvent]struct{}
+
+	// Subscribe/Unsubscribe requests for controlSubscribers
+	subscribeControl chan chan ControlEvent
+	unsubscribeControl chan chan ControlEvent
 
 	// Attached DNS-SD discovery registration and browser for this Named Web Socket
 	discoveryClient *DiscoveryClient
 }
 
+// ControlEventKind identifies the kind of lifecycle event carried by a ControlEvent.
+type ControlEventKind string
+
+const (
+	PeerConnected ControlEventKind = "peer-connected"
+	PeerDisconnected ControlEventKind = "peer-disconnected"
+)
+
+// ControlEvent describes a peer joining or leaving a NamedWebSocket. It's
+// delivered to channels registered via Subscribe, and, for connections that
+// opted into the structured protocol, relayed as a JSON envelope.
+type ControlEvent struct {
+	Kind ControlEventKind
+	PeerID string
+	Timestamp time.Time
+}
+
+// wsFrame is an outbound message queued on a Connection's send channel.
+// writeConnectionPump coalesces consecutive frames into a single
+// newline-separated TextMessage to drain backlog efficiently; a frame
+// carrying a JSON envelope sets noCoalesce so it's always written in its
+// own WriteMessage call instead, since joining two JSON documents with a
+// newline would produce a frame that isn't valid JSON.
+type wsFrame struct {
+	payload []byte
+	noCoalesce bool
+}
+
 type Connection struct {
 	ws *websocket.Conn
 	isProxy bool
+
+	// Buffered channel of outbound messages queued for this connection
+	send chan wsFrame
+
+	// Stable identifier assigned to non-proxy connections on registration,
+	// used as the target of directed ("to") publish messages
+	peerID string
+
+	// Unix nanosecond timestamp of the last message received from this
+	// peer. Written by readConnectionPump and read by writeConnectionPump
+	// to enforce DisconnectAfter, so it's accessed atomically since the
+	// two pumps run on different goroutines.
+	lastActivity int64
 }
 
 type WSMessage struct {
@@ -48,26 +190,65 @@ type WSMessage struct {
 	payload []byte
 }
 
+// wsEnvelope is the opt-in structured message format for a NamedWebSocket.
+// A client may send {"action":"subscribe","topic":"..."} / "unsubscribe" to
+// manage its topic subscriptions, or {"action":"publish","topic":"...",
+// "payload":...,"to":"<peerID>"} to publish - routed to a topic's
+// subscribers, or directly to a single peer when To is set. Payloads that
+// don't parse as an envelope fall back to the legacy broadcast-to-all behavior.
+type wsEnvelope struct {
+	Action string `json:"action"`
+	Topic string `json:"topic,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	To string `json:"to,omitempty"`
+}
+
+// newPeerID returns a random RFC 4122 version 4 UUID string used to
+// identify a non-proxy connection as the target of a directed publish.
+func newPeerID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  2048,
 	WriteBufferSize: 2048,
+	EnableCompression: true,
 	CheckOrigin: func(r *http.Request) bool {
 		return true // allow all origins
 	},
 }
 
-// Create a new NamedWebSocket instance (local or broadcast-based) with a given service type
-func NewNamedWebSocket(serviceName string, isBroadcast bool) *NamedWebSocket {
+// Create a new NamedWebSocket instance (local or broadcast-based) with a
+// given service type. A nil cfg falls back to the package-level defaults.
+func NewNamedWebSocket(serviceName string, isBroadcast bool, cfg *NamedWebSocketConfig) *NamedWebSocket {
 	scope := "broadcast"
 	if isBroadcast == false {
 		scope = "local"
 	}
 
+	if cfg == nil {
+		cfg = defaultNamedWebSocketConfig(isBroadcast)
+	}
+
 	sock := &NamedWebSocket{
 		serviceName: serviceName,
-		connections: make([]*Connection, 0),
+		config: cfg,
+		connections: make(map[*Connection]struct{}),
+		peers: make(map[string]*Connection),
+		subscriptions: make(map[*Connection]map[string]struct{}),
+		register: make(chan *Connection),
+		unregister: make(chan *Connection),
 		broadcastBuffer: make(chan *WSMessage, 512),
-		controlBuffer: make(chan *WSMessage, 512),
+		protocolOptIn: make(map[*Connection]struct{}),
+		controlSubscribers: make(map[chan ControlEvent]struct{}),
+		subscribeControl: make(chan chan ControlEvent),
+		unsubscribeControl: make(chan chan ControlEvent),
 	}
 
 	go sock.messageDispatcher()
@@ -88,6 +269,20 @@ func (sock *NamedWebSocket) advertise() {
 	}
 }
 
+// Subscribe registers ch to receive peer connect/disconnect lifecycle
+// events for this NamedWebSocket, so the surrounding server (or a test) can
+// observe join/leave without parsing websocket frames. ch should be
+// buffered; a full channel simply misses events rather than blocking the
+// dispatcher.
+func (sock *NamedWebSocket) Subscribe(ch chan ControlEvent) {
+	sock.subscribeControl <- ch
+}
+
+// Unsubscribe stops ch from receiving lifecycle events registered via Subscribe.
+func (sock *NamedWebSocket) Unsubscribe(ch chan ControlEvent) {
+	sock.unsubscribeControl <- ch
+}
+
 // Set up a new web socket connection
 func (sock *NamedWebSocket) serve(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -113,9 +308,18 @@ func (sock *NamedWebSocket) serve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if sock.config.EnableCompression {
+		ws.SetCompressionLevel(sock.config.CompressionLevel)
+	}
+	// writeFrame switches write compression off per message below
+	// MinCompressSize; this also covers proxy-to-proxy relays, which share the same Upgrader.
+	ws.EnableWriteCompression(sock.config.EnableCompression)
+
 	conn := &Connection{
 		ws: ws,
 		isProxy: isProxy,
+		send: make(chan wsFrame, sendBufferSize),
+		lastActivity: time.Now().UnixNano(),
 	}
 
 	sock.addConnection(conn)
@@ -131,14 +335,18 @@ func (sock *NamedWebSocket) readConnectionPump(conn *Connection) {
 		conn.ws.Close()
 		sock.removeConnection(conn)
 	}()
-	conn.ws.SetReadLimit(maxMessageSize)
-	conn.ws.SetReadDeadline(time.Now().Add(pongWait))
-	conn.ws.SetPongHandler(func(string) error { conn.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	conn.ws.SetReadLimit(sock.config.MaxMessageSize)
+	conn.ws.SetReadDeadline(time.Now().Add(sock.config.ReadTimeout))
+	conn.ws.SetPongHandler(func(string) error {
+		conn.ws.SetReadDeadline(time.Now().Add(sock.config.ReadTimeout))
+		return nil
+	})
 	for {
 		_, message, err := conn.ws.ReadMessage()
 		if err != nil {
 			break
 		}
+		atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
 		wsBroadcast := &WSMessage{
 			source: conn,
 			payload: message,
@@ -147,18 +355,202 @@ func (sock *NamedWebSocket) readConnectionPump(conn *Connection) {
 	}
 }
 
-// writeConnectionPump keeps an individual websocket connection alive
+// writeConnectionPump keeps an individual websocket connection alive,
+// drains its outbound queue (coalescing runs of plain messages that piled up
+// while a write was in flight into a single newline-separated frame), and
+// disconnects non-proxy peers that have been idle for sock.config.DisconnectAfter.
+// A DisconnectAfter of zero or less disables idle eviction for this socket.
 func (sock *NamedWebSocket) writeConnectionPump(conn *Connection) {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(sock.config.PingFrequency)
 	defer func() {
 		ticker.Stop()
 		conn.ws.Close()
 		sock.removeConnection(conn)
 	}()
+
+	// idleTimer is reused across loop iterations via Reset instead of being
+	// recreated with time.After each time around, which would otherwise leak
+	// a live timer per iteration until it eventually fired. It's left nil
+	// (and idleTimeout stays nil, so that case of the select below never
+	// fires) for proxy connections and whenever DisconnectAfter is configured
+	// to disable idle eviction.
+	var idleTimer *time.Timer
+	var idleTimeout <-chan time.Time
+	if !conn.isProxy && sock.config.DisconnectAfter > 0 {
+		idleTimer = time.NewTimer(sock.config.DisconnectAfter)
+		idleTimeout = idleTimer.C
+		defer idleTimer.Stop()
+	}
+
 	for {
+		if idleTimer != nil {
+			lastActivity := time.Unix(0, atomic.LoadInt64(&conn.lastActivity))
+			if !idleTimer.Stop() {
+				select {
+				case <-idleTimer.C:
+				default:
+				}
+			}
+			idleTimer.Reset(sock.config.DisconnectAfter - time.Since(lastActivity))
+		}
+
 		select {
-			case <-ticker.C:
-				sock.write(conn, websocket.PingMessage, []byte{})
+		case frame, ok := <-conn.send:
+			if !ok {
+				sock.write(conn, websocket.CloseMessage, []byte{})
+				return
+			}
+
+			// Drain whatever else is already queued so one slow write
+			// doesn't let the backlog pile up indefinitely, then write it
+			// out: runs of coalescable frames are joined into a single
+			// newline-separated TextMessage, while noCoalesce frames (JSON
+			// envelopes and connect/disconnect sentinels) are always
+			// written on their own.
+			pending := len(conn.send)
+			frames := make([]wsFrame, 1, pending+1)
+			frames[0] = frame
+			for i := 0; i < pending; i++ {
+				frames = append(frames, <-conn.send)
+			}
+
+			if err := sock.flushFrames(conn, frames); err != nil {
+				return
+			}
+		case <-ticker.C:
+			sock.write(conn, websocket.PingMessage, []byte{})
+		case <-idleTimeout:
+			// The client may have sent something after the timer was last
+			// armed; if so, go round again and re-arm it from lastActivity.
+			lastActivity := time.Unix(0, atomic.LoadInt64(&conn.lastActivity))
+			if time.Since(lastActivity) < sock.config.DisconnectAfter {
+				continue
+			}
+			// Client has been silent for too long; drop the connection.
+			return
+		}
+	}
+}
+
+// flushFrames writes a batch of queued frames to conn, joining consecutive
+// coalescable frames into a single newline-separated TextMessage and
+// writing each noCoalesce frame (a JSON envelope or a connect/disconnect
+// sentinel) on its own, so structured
+// clients never receive two JSON documents joined into one invalid frame.
+func (sock *NamedWebSocket) flushFrames(conn *Connection, frames []wsFrame) error {
+	var buf []byte
+
+	flushBuf := func() error {
+		if buf == nil {
+			return nil
+		}
+		err := sock.writeFrame(conn, buf)
+		buf = nil
+		return err
+	}
+
+	for _, frame := range frames {
+		if frame.noCoalesce {
+			if err := flushBuf(); err != nil {
+				return err
+			}
+			if err := sock.writeFrame(conn, frame.payload); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if buf == nil {
+			// payload may still be referenced by other peers' send channels
+			// (broadcast enqueues the same slice to everyone), so copy
+			// before appending onto it.
+			buf = append([]byte(nil), frame.payload...)
+		} else {
+			buf = append(buf, '\n')
+			buf = append(buf, frame.payload...)
+		}
+	}
+
+	return flushBuf()
+}
+
+// writeFrame writes a single text frame to conn, skipping compression for
+// frames below the configured threshold since the deflate overhead isn't
+// worth it for small payloads.
+func (sock *NamedWebSocket) writeFrame(conn *Connection, payload []byte) error {
+	conn.ws.EnableWriteCompression(sock.config.EnableCompression && len(payload) >= sock.config.MinCompressSize)
+	conn.ws.SetWriteDeadline(time.Now().Add(sock.config.WriteTimeout))
+	return conn.ws.WriteMessage(websocket.TextMessage, payload)
+}
+
+// handleMessage routes an inbound message. Subscribe/unsubscribe envelopes
+// update the sender's topic set; publish envelopes fan out by topic or
+// target a single peer; anything that isn't a recognized envelope falls
+// back to the legacy broadcast-to-all behavior. Proxy connections always
+// use the legacy broadcast so cross-host DNS-SD bridging is unaffected by
+// the topic/subscription model.
+func (sock *NamedWebSocket) handleMessage(msg *WSMessage) {
+	if msg.source.isProxy {
+		sock.broadcast(msg)
+		return
+	}
+
+	var envelope wsEnvelope
+	if err := json.Unmarshal(msg.payload, &envelope); err != nil {
+		sock.broadcast(msg)
+		return
+	}
+
+	switch envelope.Action {
+	case "subscribe":
+		if envelope.Topic == "" {
+			return
+		}
+		sock.protocolOptIn[msg.source] = struct{}{}
+		if sock.subscriptions[msg.source] == nil {
+			sock.subscriptions[msg.source] = make(map[string]struct{})
+		}
+		sock.subscriptions[msg.source][envelope.Topic] = struct{}{}
+	case "unsubscribe":
+		sock.protocolOptIn[msg.source] = struct{}{}
+		delete(sock.subscriptions[msg.source], envelope.Topic)
+	case "publish":
+		sock.protocolOptIn[msg.source] = struct{}{}
+		sock.publish(msg.source, &envelope)
+	default:
+		sock.broadcast(msg)
+	}
+}
+
+// publish routes a published envelope to the peer named in its To field,
+// or to every other connection subscribed to its Topic when To is empty.
+// It's also fanned out to proxy connections, same as the legacy broadcast
+// path, since a directed or topic target may be a peer that only exists on
+// the other side of a cross-host DNS-SD bridge.
+func (sock *NamedWebSocket) publish(source *Connection, envelope *wsEnvelope) {
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return
+	}
+
+	if envelope.To != "" {
+		if target, ok := sock.peers[envelope.To]; ok && target != source {
+			sock.enqueue(target, payload, true)
+		}
+	} else {
+		for conn, topics := range sock.subscriptions {
+			if conn == source {
+				continue
+			}
+			if _, subscribed := topics[envelope.Topic]; subscribed {
+				sock.enqueue(conn, payload, true)
+			}
+		}
+	}
+
+	for conn := range sock.connections {
+		if conn.isProxy {
+			sock.enqueue(conn, payload, true)
 		}
 	}
 }
@@ -167,85 +559,187 @@ func (sock *NamedWebSocket) writeConnectionPump(conn *Connection) {
 func (sock *NamedWebSocket) messageDispatcher() {
 	for {
 		select {
-		case wsConnect, ok := <-sock.controlBuffer:
-			if !ok {
-				sock.write(wsConnect.source, websocket.CloseMessage, []byte{})
-				return
-			}
-			sock.broadcast(wsConnect)
+		case conn := <-sock.register:
+			sock.registerConnection(conn)
+		case conn := <-sock.unregister:
+			sock.unregisterConnection(conn)
+		case ch := <-sock.subscribeControl:
+			sock.controlSubscribers[ch] = struct{}{}
+		case ch := <-sock.unsubscribeControl:
+			delete(sock.controlSubscribers, ch)
 		case wsBroadcast, ok := <-sock.broadcastBuffer:
 			if !ok {
 				sock.write(wsBroadcast.source, websocket.CloseMessage, []byte{})
 				return
 			}
-			sock.broadcast(wsBroadcast)
+			sock.handleMessage(wsBroadcast)
 		}
 	}
 }
 
-// Set up a new NamedWebSocket connection instance
-func (sock *NamedWebSocket) addConnection(conn *Connection) {
+// Set up a new NamedWebSocket connection instance. Only ever called on the
+// messageDispatcher goroutine so sock.connections needs no locking.
+func (sock *NamedWebSocket) registerConnection(conn *Connection) {
 
-	connectPayload := []byte("____connect")
+	connectFrame := wsFrame{payload: []byte("____connect"), noCoalesce: true}
 
 	// Notify new websocket connection of existing websocket connections
-	for _, oConn := range sock.connections {
+	for oConn := range sock.connections {
 		if !conn.isProxy || (conn.isProxy && !oConn.isProxy) {
-			sock.write(conn, websocket.TextMessage, connectPayload)
+			select {
+			case conn.send <- connectFrame:
+			default:
+			}
 		}
 	}
 
 	if !conn.isProxy {
-		// Connect message
-		wsConnect := &WSMessage{
-			source: conn,
-			payload: []byte("____connect"),
-		}
-
-		// Broadcast new connect event to all existing named websocket connections
-		sock.controlBuffer <- wsConnect
+		conn.peerID = newPeerID()
+		sock.peers[conn.peerID] = conn
+
+		// Notify lifecycle subscribers and structured-protocol peers that a
+		// new peer has joined. Called inline rather than via a channel since
+		// registerConnection only ever runs on the messageDispatcher
+		// goroutine, which is also the only reader - a self-send would risk
+		// deadlocking the dispatcher if the channel ever filled up.
+		sock.emitControlEvent(&ControlEvent{
+			Kind: PeerConnected,
+			PeerID: conn.peerID,
+			Timestamp: time.Now(),
+		})
 	}
 
 	// Add this websocket instance to connections
-	sock.connections = append( sock.connections, conn )
+	sock.connections[conn] = struct{}{}
+}
+
+// Tear down an existing NamedWebSocket connection instance. Only ever called
+// on the messageDispatcher goroutine so sock.connections needs no locking.
+func (sock *NamedWebSocket) unregisterConnection(conn *Connection) {
+	peerID := conn.peerID
+	removed := sock.removeFromHub(conn)
+
+	// readConnectionPump and writeConnectionPump both defer removeConnection,
+	// so this runs twice per connection; only the call that actually removed
+	// conn from the hub should emit the lifecycle event, or subscribers and
+	// peers would see every disconnect twice.
+	if removed && !conn.isProxy {
+		// Notify lifecycle subscribers and structured-protocol peers that
+		// this peer has left. Called inline for the same reason as
+		// registerConnection's PeerConnected event above.
+		sock.emitControlEvent(&ControlEvent{
+			Kind: PeerDisconnected,
+			PeerID: peerID,
+			Timestamp: time.Now(),
+		})
+	}
+}
+
+// Set up a new NamedWebSocket connection instance
+func (sock *NamedWebSocket) addConnection(conn *Connection) {
+	sock.register <- conn
+}
+
+// Tear down an existing NamedWebSocket connection instance
+func (sock *NamedWebSocket) removeConnection(conn *Connection) {
+	sock.unregister <- conn
 }
 
 // Send a message to the target websocket connection
 func (sock *NamedWebSocket) write(conn *Connection, mt int, payload []byte) {
-	conn.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.ws.SetWriteDeadline(time.Now().Add(sock.config.WriteTimeout))
 	conn.ws.WriteMessage(mt, payload)
 }
 
 // Broadcast a message to all websocket connections for this NamedWebSocket
-// instance (except to the src websocket connection)
+// instance (except to the src websocket connection). Queues onto each
+// peer's outbound channel rather than writing synchronously, so one slow
+// client can't stall delivery to everyone else. If a peer's queue is full,
+// it's dropped from the hub instead of blocking the dispatcher.
 func (sock *NamedWebSocket) broadcast(broadcast *WSMessage) {
-	for _, conn := range sock.connections {
-		if conn.ws != broadcast.source.ws {
-			// don't relay messages infinitely between proxy connections
-			if (conn.isProxy && broadcast.source.isProxy) {
-				continue
-			}
-			sock.write(conn, websocket.TextMessage, broadcast.payload)
+	for conn := range sock.connections {
+		if conn.ws == broadcast.source.ws {
+			continue
+		}
+		// don't relay messages infinitely between proxy connections
+		if conn.isProxy && broadcast.source.isProxy {
+			continue
 		}
+
+		sock.enqueue(conn, broadcast.payload, false)
 	}
 }
 
-// Tear down an existing NamedWebSocket connection instance
-func (sock *NamedWebSocket) removeConnection(conn *Connection) {
-	for i, oConn := range sock.connections {
-		if oConn.ws == conn.ws {
-			sock.connections = append(sock.connections[:i], sock.connections[i+1:]...)
-			break
+// emitControlEvent delivers a peer lifecycle event to external Subscribe
+// channels, then relays it to this socket's connections: a JSON envelope
+// for peers that opted into the structured protocol, and the legacy
+// connect/disconnect sentinel for everyone else so old clients keep working.
+func (sock *NamedWebSocket) emitControlEvent(event *ControlEvent) {
+	for ch := range sock.controlSubscribers {
+		select {
+		case ch <- *event:
+		default:
 		}
 	}
 
-	if !conn.isProxy {
-		// Broadcast new disconnect event to all existing named websocket connections
-		wsDisconnect := &WSMessage{
-			source: conn,
-			payload: []byte("____disconnect"),
+	action := "peer-connected"
+	legacyPayload := []byte("____connect")
+	if event.Kind == PeerDisconnected {
+		action = "peer-disconnected"
+		legacyPayload = []byte("____disconnect")
+	}
+	envelopePayload, envelopeErr := json.Marshal(map[string]string{
+		"action": action,
+		"id": event.PeerID,
+	})
+
+	for conn := range sock.connections {
+		if conn.peerID == event.PeerID {
+			continue
+		}
+		if _, optedIn := sock.protocolOptIn[conn]; optedIn && envelopeErr == nil {
+			sock.enqueue(conn, envelopePayload, true)
+		} else {
+			// noCoalesce so an old client's exact-match "____connect" /
+			// "____disconnect" check never sees the sentinel merged with
+			// another queued frame into "____connect\n<data>".
+			sock.enqueue(conn, legacyPayload, true)
 		}
+	}
+}
 
-		sock.controlBuffer <- wsDisconnect
+// enqueue queues payload onto conn's outbound channel without blocking. If
+// the channel is full, conn is dropped from the hub instead of stalling the
+// dispatcher. noCoalesce must be set for structured JSON envelopes and for
+// legacy sentinels so writeConnectionPump never merges them with other
+// queued frames.
+func (sock *NamedWebSocket) enqueue(conn *Connection, payload []byte, noCoalesce bool) {
+	select {
+	case conn.send <- wsFrame{payload: payload, noCoalesce: noCoalesce}:
+	default:
+		if sock.removeFromHub(conn) && !conn.isProxy {
+			sock.emitControlEvent(&ControlEvent{
+				Kind: PeerDisconnected,
+				PeerID: conn.peerID,
+				Timestamp: time.Now(),
+			})
+		}
 	}
-}
\ No newline at end of file
+}
+
+// removeFromHub drops conn from the hub's connection set, peer index, and
+// subscriptions, closing its outbound channel. Only ever called on the
+// messageDispatcher goroutine. Reports whether conn was actually removed,
+// since readConnectionPump and writeConnectionPump both defer
+// removeConnection and callers must not act twice on the same teardown.
+func (sock *NamedWebSocket) removeFromHub(conn *Connection) bool {
+	if _, ok := sock.connections[conn]; !ok {
+		return false
+	}
+	delete(sock.connections, conn)
+	delete(sock.peers, conn.peerID)
+	delete(sock.subscriptions, conn)
+	delete(sock.protocolOptIn, conn)
+	close(conn.send)
+	return true
+}